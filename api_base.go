@@ -3,7 +3,9 @@ package msg2api
 import (
 	"errors"
 	"github.com/gorilla/websocket"
+	"net"
 	"net/http"
+	"sync"
 	"time"
 )
 
@@ -12,36 +14,109 @@ const (
 
 	deviceAPIProtocolV1 = "v2.device.msg"
 	userAPIProtocolV3   = "v5.user.msg"
+
+	defaultReadLimit = 4096
 )
 
 var errProtocolNegotiationFailed = errors.New("protocol negotiation failed")
+var errClosed = errors.New("connection closed")
 
 type apiBase struct {
 	socket *socketWrapper
+	codec  Codec
+
+	done     chan struct{}
+	closeErr sync.Once
+
+	writes      chan writeRequest
+	dispatchSem chan struct{}
 }
 
 func (b *apiBase) Close() {
-	b.socket.Close(websocket.CloseGoingAway, "")
+	b.closeWith(websocket.CloseGoingAway, "")
 }
 
-func initAPIBaseFromSocket(conn *websocket.Conn) (*apiBase, error) {
+// closeWith closes the underlying socket with the given close code and
+// reason and, the first time it's called, stops any running keepalive
+// goroutine.
+func (b *apiBase) closeWith(code int, reason string) {
+	b.closeErr.Do(func() {
+		close(b.done)
+	})
+	b.socket.Close(code, reason)
+}
+
+// isTimeout reports whether err is a read/write timeout, as produced by a
+// KeepaliveConfig deadline expiring with no pong received.
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// WriteValue encodes v with the negotiated Codec and sends it as a single
+// websocket message. It is safe to call concurrently: every write is
+// funneled through a single serializer goroutine (see runWriter) so
+// dispatched commands and Broadcaster deliveries can't interleave their
+// frames on the wire.
+func (b *apiBase) WriteValue(v interface{}) error {
+	data, messageType, err := b.codec.Encode(v)
+	if err != nil {
+		return err
+	}
+
+	result := make(chan error, 1)
+	select {
+	case b.writes <- writeRequest{messageType: messageType, data: data, result: result}:
+	case <-b.done:
+		return errClosed
+	}
+	return <-result
+}
+
+// ReadValue reads the next websocket message and decodes it into v with
+// the negotiated Codec.
+func (b *apiBase) ReadValue(v interface{}) error {
+	messageType, data, err := b.socket.readRaw()
+	if err != nil {
+		return err
+	}
+	return b.codec.Decode(messageType, data, v)
+}
+
+func initAPIBaseFromSocket(conn *websocket.Conn, opts ...Option) (*apiBase, error) {
 	if conn.Subprotocol() == "" {
 		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseProtocolError, ""))
 		conn.Close()
 		return nil, errProtocolNegotiationFailed
 	}
 
-	conn.SetReadLimit(4096)
+	cfg := newAPIBaseConfig(opts)
+
+	conn.SetReadLimit(cfg.readLimit)
+
+	base := &apiBase{
+		socket:      wrapWebsocket(conn),
+		codec:       codecForSubprotocol(conn.Subprotocol()),
+		done:        make(chan struct{}),
+		writes:      make(chan writeRequest),
+		dispatchSem: make(chan struct{}, cfg.workerPoolSize),
+	}
+
+	go base.runWriter()
+	base.startKeepalive(cfg.keepalive)
 
-	return &apiBase{
-		socket: wrapWebsocket(conn),
-	}, nil
+	return base, nil
 }
 
-func initAPIBaseFromHTTP(w http.ResponseWriter, r *http.Request, protocols []string) (*apiBase, error) {
+// initAPIBaseFromHTTP upgrades r to a websocket offering both protocols and
+// their CBOR-framed siblings (e.g. "v2.device.msg+cbor"), so a client that
+// asks for one gets JSONCodec and a client that asks for the other gets
+// CBORCodec. Pass WithReadLimit to override the default per-message size
+// limit on the resulting connection.
+func initAPIBaseFromHTTP(w http.ResponseWriter, r *http.Request, protocols []string, opts ...Option) (*apiBase, error) {
 	upgrader := websocket.Upgrader{
 		HandshakeTimeout: upgradeTimeout,
-		Subprotocols:     protocols,
+		Subprotocols:     withCBORVariant(protocols),
 	}
 
 	conn, err := upgrader.Upgrade(w, r, nil)
@@ -49,5 +124,5 @@ func initAPIBaseFromHTTP(w http.ResponseWriter, r *http.Request, protocols []str
 		return nil, err
 	}
 
-	return initAPIBaseFromSocket(conn)
+	return initAPIBaseFromSocket(conn, opts...)
 }
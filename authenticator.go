@@ -0,0 +1,216 @@
+package msg2api
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Authenticator authenticates a device connecting to a DeviceServer before
+// any commands are accepted from it.
+type Authenticator interface {
+	// Authenticate runs the handshake over socket and returns the
+	// authenticated device's ID, or an error if authentication failed.
+	Authenticate(socket *socketWrapper) (deviceID string, err error)
+}
+
+// HMACChallengeAuthenticator authenticates a device with the original
+// random-challenge handshake: the server sends a random hex challenge and
+// the device must answer with hex(HMAC-SHA256(challenge, Key)).
+type HMACChallengeAuthenticator struct {
+	// DeviceID is returned from Authenticate on success. The challenge
+	// handshake has no way to learn the device's identity on its own, so
+	// callers must already know it (e.g. from the connection's URL).
+	DeviceID string
+	Key      []byte
+}
+
+func (a *HMACChallengeAuthenticator) sendChallenge(socket *socketWrapper) ([]byte, error) {
+	var buf [sha256.Size]byte
+
+	if _, err := rand.Read(buf[:]); err != nil {
+		return nil, err
+	}
+
+	if err := socket.Write(hex.EncodeToString(buf[:])); err != nil {
+		return nil, err
+	}
+	return buf[:], nil
+}
+
+func (a *HMACChallengeAuthenticator) validateResponse(socket *socketWrapper, challenge, response []byte) (string, error) {
+	msg, err := hex.DecodeString(string(response))
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, a.Key)
+	mac.Write(challenge)
+	expected := mac.Sum(nil)
+	if !hmac.Equal(msg, expected) {
+		return "", errAuthenticationFailed
+	}
+
+	if err := socket.Write("proceed"); err != nil {
+		return "", err
+	}
+	return a.DeviceID, nil
+}
+
+// Authenticate implements Authenticator.
+func (a *HMACChallengeAuthenticator) Authenticate(socket *socketWrapper) (string, error) {
+	challenge, err := a.sendChallenge(socket)
+	if err != nil {
+		return "", err
+	}
+
+	response, err := socket.Receive()
+	if err != nil {
+		return "", err
+	}
+
+	return a.validateResponse(socket, challenge, response)
+}
+
+var errJWTReplayed = errors.New("jwt already used")
+
+// JWTAuthenticator authenticates a device by validating a JWT it presents
+// instead of completing the HMAC challenge round-trip. The token must carry
+// claims sub (the device ID), iat, exp, nbf and jti.
+type JWTAuthenticator struct {
+	// LookupKey returns the key and algorithm ("HS256" or "RS256")
+	// expected for the device identified by the token's sub claim.
+	LookupKey func(deviceID string) (key []byte, alg string, err error)
+
+	// SeenJTI reports whether jti has already been used by deviceID, and
+	// records it as used. It guards against replaying a captured token.
+	SeenJTI func(deviceID, jti string) (seen bool, err error)
+}
+
+// looksLikeJWT reports whether data has the three base64url segments,
+// separated by dots, of a JWT in compact serialization.
+func looksLikeJWT(data []byte) bool {
+	segments := bytes.Split(data, []byte("."))
+	if len(segments) != 3 {
+		return false
+	}
+	for _, seg := range segments {
+		for _, c := range seg {
+			if !(c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (a *JWTAuthenticator) authenticateToken(raw []byte) (string, error) {
+	var deviceID string
+
+	token, err := jwt.Parse(string(raw), func(t *jwt.Token) (interface{}, error) {
+		claims, ok := t.Claims.(jwt.MapClaims)
+		if !ok {
+			return nil, errAuthenticationFailed
+		}
+
+		sub, ok := claims["sub"].(string)
+		if !ok || sub == "" {
+			return nil, errAuthenticationFailed
+		}
+		deviceID = sub
+
+		key, alg, err := a.LookupKey(sub)
+		if err != nil {
+			return nil, err
+		}
+		if t.Method.Alg() != alg {
+			return nil, errAuthenticationFailed
+		}
+
+		switch alg {
+		case "RS256":
+			return jwt.ParseRSAPublicKeyFromPEM(key)
+		default:
+			return key, nil
+		}
+	}, jwt.WithValidMethods([]string{"HS256", "RS256"}), jwt.WithExpirationRequired())
+	if err != nil || !token.Valid {
+		return "", errAuthenticationFailed
+	}
+
+	claims := token.Claims.(jwt.MapClaims)
+
+	jti, _ := claims["jti"].(string)
+	if jti == "" {
+		return "", errAuthenticationFailed
+	}
+
+	// WithExpirationRequired only covers exp; iat and nbf are just as much
+	// part of the required claim set (a provisioning-issued token without
+	// them can't be bounded to a short lifetime), so check their presence
+	// by hand.
+	if _, ok := claims["iat"]; !ok {
+		return "", errAuthenticationFailed
+	}
+	if _, ok := claims["nbf"]; !ok {
+		return "", errAuthenticationFailed
+	}
+
+	seen, err := a.SeenJTI(deviceID, jti)
+	if err != nil {
+		return "", err
+	}
+	if seen {
+		return "", errJWTReplayed
+	}
+
+	return deviceID, nil
+}
+
+// Authenticate implements Authenticator.
+func (a *JWTAuthenticator) Authenticate(socket *socketWrapper) (string, error) {
+	raw, err := socket.Receive()
+	if err != nil {
+		return "", err
+	}
+	return a.authenticateToken(raw)
+}
+
+// HybridAuthenticator accepts either a signed JWT or the legacy HMAC
+// challenge-response over the same socket. It reads the device's first
+// frame and classifies it before speaking: three dot-separated base64url
+// segments are validated as a JWT via JWT; anything else is treated as a
+// device that expects the old challenge-response handshake, so only then
+// is the HMAC challenge sent.
+type HybridAuthenticator struct {
+	HMAC *HMACChallengeAuthenticator
+	JWT  *JWTAuthenticator
+}
+
+// Authenticate implements Authenticator.
+func (a *HybridAuthenticator) Authenticate(socket *socketWrapper) (string, error) {
+	first, err := socket.Receive()
+	if err != nil {
+		return "", err
+	}
+
+	if looksLikeJWT(bytes.TrimSpace(first)) {
+		return a.JWT.authenticateToken(first)
+	}
+
+	challenge, err := a.HMAC.sendChallenge(socket)
+	if err != nil {
+		return "", err
+	}
+
+	response, err := socket.Receive()
+	if err != nil {
+		return "", err
+	}
+	return a.HMAC.validateResponse(socket, challenge, response)
+}
@@ -0,0 +1,152 @@
+package msg2api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func signTestToken(t *testing.T, key []byte, claims jwt.MapClaims) string {
+	t.Helper()
+
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(key)
+	if err != nil {
+		t.Fatalf("signing test token: %v", err)
+	}
+	return signed
+}
+
+// validTestClaims returns a claim set carrying the full {sub, iat, exp, nbf,
+// jti} set JWTAuthenticator requires, valid right now.
+func validTestClaims(sub, jti string) jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"sub": sub,
+		"jti": jti,
+		"iat": jwt.NewNumericDate(now),
+		"nbf": jwt.NewNumericDate(now),
+		"exp": jwt.NewNumericDate(now.Add(time.Minute)),
+	}
+}
+
+func TestJWTAuthenticatorAuthenticateToken(t *testing.T) {
+	key := []byte("test-key")
+
+	a := &JWTAuthenticator{
+		LookupKey: func(deviceID string) ([]byte, string, error) {
+			return key, "HS256", nil
+		},
+		SeenJTI: func(deviceID, jti string) (bool, error) {
+			return false, nil
+		},
+	}
+
+	signed := signTestToken(t, key, validTestClaims("device1", "abc123"))
+
+	deviceID, err := a.authenticateToken([]byte(signed))
+	if err != nil {
+		t.Fatalf("authenticateToken: %v", err)
+	}
+	if deviceID != "device1" {
+		t.Fatalf("authenticateToken returned deviceID %q, want %q", deviceID, "device1")
+	}
+}
+
+func TestJWTAuthenticatorRejectsReplayedJTI(t *testing.T) {
+	key := []byte("test-key")
+
+	a := &JWTAuthenticator{
+		LookupKey: func(deviceID string) ([]byte, string, error) {
+			return key, "HS256", nil
+		},
+		SeenJTI: func(deviceID, jti string) (bool, error) {
+			return true, nil
+		},
+	}
+
+	signed := signTestToken(t, key, validTestClaims("device1", "abc123"))
+
+	if _, err := a.authenticateToken([]byte(signed)); err != errJWTReplayed {
+		t.Fatalf("authenticateToken error = %v, want errJWTReplayed", err)
+	}
+}
+
+func TestJWTAuthenticatorRejectsAlgorithmMismatch(t *testing.T) {
+	key := []byte("test-key")
+
+	a := &JWTAuthenticator{
+		LookupKey: func(deviceID string) ([]byte, string, error) {
+			return key, "RS256", nil
+		},
+		SeenJTI: func(deviceID, jti string) (bool, error) {
+			return false, nil
+		},
+	}
+
+	signed := signTestToken(t, key, validTestClaims("device1", "abc123"))
+
+	if _, err := a.authenticateToken([]byte(signed)); err != errAuthenticationFailed {
+		t.Fatalf("authenticateToken error = %v, want errAuthenticationFailed", err)
+	}
+}
+
+func TestJWTAuthenticatorRejectsMissingExpiration(t *testing.T) {
+	key := []byte("test-key")
+
+	a := &JWTAuthenticator{
+		LookupKey: func(deviceID string) ([]byte, string, error) {
+			return key, "HS256", nil
+		},
+		SeenJTI: func(deviceID, jti string) (bool, error) {
+			return false, nil
+		},
+	}
+
+	claims := validTestClaims("device1", "abc123")
+	delete(claims, "exp")
+	signed := signTestToken(t, key, claims)
+
+	if _, err := a.authenticateToken([]byte(signed)); err != errAuthenticationFailed {
+		t.Fatalf("authenticateToken error = %v, want errAuthenticationFailed for a token with no exp claim", err)
+	}
+}
+
+func TestJWTAuthenticatorRejectsMissingIssuedAtAndNotBefore(t *testing.T) {
+	key := []byte("test-key")
+
+	a := &JWTAuthenticator{
+		LookupKey: func(deviceID string) ([]byte, string, error) {
+			return key, "HS256", nil
+		},
+		SeenJTI: func(deviceID, jti string) (bool, error) {
+			return false, nil
+		},
+	}
+
+	claims := validTestClaims("device1", "abc123")
+	delete(claims, "iat")
+	delete(claims, "nbf")
+	signed := signTestToken(t, key, claims)
+
+	if _, err := a.authenticateToken([]byte(signed)); err != errAuthenticationFailed {
+		t.Fatalf("authenticateToken error = %v, want errAuthenticationFailed for a token with no iat/nbf claims", err)
+	}
+}
+
+func TestLooksLikeJWT(t *testing.T) {
+	cases := []struct {
+		data []byte
+		want bool
+	}{
+		{[]byte("a.b.c"), true},
+		{[]byte("deadbeef"), false},
+		{[]byte("a.b"), false},
+	}
+
+	for _, c := range cases {
+		if got := looksLikeJWT(c.data); got != c.want {
+			t.Errorf("looksLikeJWT(%q) = %v, want %v", c.data, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package msg2api
+
+import (
+	"sync"
+)
+
+const broadcastSendBuffer = 16
+
+// BroadcastTarget is the subset of UserServer a Broadcaster needs in order
+// to deliver a realtime update to a subscriber's socket.
+type BroadcastTarget interface {
+	deliverUpdate(msg MessageOut) error
+}
+
+// broadcastSocket tracks one subscriber's interest in a single device. It
+// buffers updates for delivery so that one slow websocket write can never
+// block the fan-out to the other subscribers of the same sensor.
+type broadcastSocket struct {
+	userID  string
+	sensors map[string]struct{}
+	target  BroadcastTarget
+
+	queue chan MessageOut
+	done  chan struct{}
+}
+
+func newBroadcastSocket(userID string, sensorIDs []string, target BroadcastTarget) *broadcastSocket {
+	sensors := make(map[string]struct{}, len(sensorIDs))
+	for _, id := range sensorIDs {
+		sensors[id] = struct{}{}
+	}
+
+	return &broadcastSocket{
+		userID:  userID,
+		sensors: sensors,
+		target:  target,
+		queue:   make(chan MessageOut, broadcastSendBuffer),
+		done:    make(chan struct{}),
+	}
+}
+
+func (s *broadcastSocket) run() {
+	for {
+		select {
+		case msg := <-s.queue:
+			s.target.deliverUpdate(msg)
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *broadcastSocket) subscribesAny(sensorIDs map[string][]Measurement) bool {
+	for sensorID := range sensorIDs {
+		if _, ok := s.sensors[sensorID]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// enqueue hands msg to the socket's writer goroutine. If the socket is
+// already falling behind, it is treated as a slow consumer and dropped
+// rather than allowed to stall delivery to every other subscriber.
+func (s *broadcastSocket) enqueue(msg MessageOut) bool {
+	select {
+	case s.queue <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// Broadcaster fans out realtime sensor updates to every UserServer socket
+// subscribed to them, so the backend only has to keep a single
+// DeviceServer.RequestRealtimeUpdates call open per (device, sensor) no
+// matter how many browser tabs are watching it. It is modelled on the
+// uibroadcaster pattern used by Stratux for its weather/traffic websockets:
+// subscribers are tracked per device, and an update is handed once to each
+// subscriber's own buffered queue instead of being written inline, so a
+// single slow socket can't hold up the rest.
+//
+// A Broadcaster is safe for concurrent use.
+type Broadcaster struct {
+	mu   sync.Mutex
+	subs map[string]map[*broadcastSocket]struct{} // deviceID -> sockets watching it
+}
+
+// NewBroadcaster returns an empty Broadcaster ready to accept subscribers.
+func NewBroadcaster() *Broadcaster {
+	return &Broadcaster{
+		subs: make(map[string]map[*broadcastSocket]struct{}),
+	}
+}
+
+// AddSocket subscribes target, acting on behalf of userID, to realtime
+// updates for sensorIDs on deviceID. It returns the subset of sensorIDs
+// that had no previous subscriber, i.e. the ones the caller must still ask
+// the device to start streaming; an already-subscribed sensor is not
+// returned again. Call RemoveSocket with the same deviceID and target to
+// undo the subscription.
+func (b *Broadcaster) AddSocket(userID, deviceID string, sensorIDs []string, target BroadcastTarget) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sockets := b.subs[deviceID]
+	if sockets == nil {
+		sockets = make(map[*broadcastSocket]struct{})
+		b.subs[deviceID] = sockets
+	}
+
+	alreadyWatched := make(map[string]struct{})
+	for sock := range sockets {
+		for sensorID := range sock.sensors {
+			alreadyWatched[sensorID] = struct{}{}
+		}
+	}
+
+	var newSensors []string
+	for _, sensorID := range sensorIDs {
+		if _, ok := alreadyWatched[sensorID]; !ok {
+			newSensors = append(newSensors, sensorID)
+		}
+	}
+
+	if existing := findSocket(sockets, target); existing != nil {
+		for _, sensorID := range sensorIDs {
+			existing.sensors[sensorID] = struct{}{}
+		}
+	} else {
+		sock := newBroadcastSocket(userID, sensorIDs, target)
+		sockets[sock] = struct{}{}
+		go sock.run()
+	}
+
+	return newSensors
+}
+
+// findSocket returns the broadcastSocket in sockets already subscribing
+// target, or nil if target has no subscription there yet.
+func findSocket(sockets map[*broadcastSocket]struct{}, target BroadcastTarget) *broadcastSocket {
+	for sock := range sockets {
+		if sock.target == target {
+			return sock
+		}
+	}
+	return nil
+}
+
+// RemoveSocket unsubscribes target from updates for deviceID.
+func (b *Broadcaster) RemoveSocket(deviceID string, target BroadcastTarget) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sockets := b.subs[deviceID]
+	if sock := findSocket(sockets, target); sock != nil {
+		delete(sockets, sock)
+		close(sock.done)
+	}
+	if len(sockets) == 0 {
+		delete(b.subs, deviceID)
+	}
+}
+
+// RemoveTarget unsubscribes target from every device it is currently
+// watching. Callers that, unlike RemoveSocket's caller, don't track which
+// devices they subscribed to (e.g. a UserServer closing after subscribing
+// to several devices over its lifetime) should use this instead.
+func (b *Broadcaster) RemoveTarget(target BroadcastTarget) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for deviceID, sockets := range b.subs {
+		if sock := findSocket(sockets, target); sock != nil {
+			delete(sockets, sock)
+			close(sock.done)
+		}
+		if len(sockets) == 0 {
+			delete(b.subs, deviceID)
+		}
+	}
+}
+
+// Send fans values, keyed by deviceID then sensorID, out to every socket
+// subscribed to at least one of the sensors it contains.
+func (b *Broadcaster) Send(values map[string]map[string][]Measurement) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for deviceID, sensors := range values {
+		sockets := b.subs[deviceID]
+		if len(sockets) == 0 {
+			continue
+		}
+
+		msg := MessageOut{
+			Command: "update",
+			Args:    map[string]map[string][]Measurement{deviceID: sensors},
+		}
+
+		for sock := range sockets {
+			if !sock.subscribesAny(sensors) {
+				continue
+			}
+			if !sock.enqueue(msg) {
+				delete(sockets, sock)
+				close(sock.done)
+			}
+		}
+	}
+}
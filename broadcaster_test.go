@@ -0,0 +1,80 @@
+package msg2api
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeBroadcastTarget struct {
+	mu  sync.Mutex
+	got []MessageOut
+}
+
+func (f *fakeBroadcastTarget) deliverUpdate(msg MessageOut) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.got = append(f.got, msg)
+	return nil
+}
+
+func (f *fakeBroadcastTarget) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.got)
+}
+
+func waitForDeliveries(t *testing.T, f *fakeBroadcastTarget, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if f.count() >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d deliveries, got %d", n, f.count())
+}
+
+func TestBroadcasterAddSocketMergesRepeatSubscriptions(t *testing.T) {
+	b := NewBroadcaster()
+	target := &fakeBroadcastTarget{}
+
+	newSensors := b.AddSocket("user1", "device1", []string{"temp"}, target)
+	if len(newSensors) != 1 || newSensors[0] != "temp" {
+		t.Fatalf("AddSocket first call returned %v, want [temp]", newSensors)
+	}
+
+	newSensors = b.AddSocket("user1", "device1", []string{"temp", "humidity"}, target)
+	if len(newSensors) != 1 || newSensors[0] != "humidity" {
+		t.Fatalf("AddSocket second call returned %v, want [humidity]", newSensors)
+	}
+
+	b.Send(map[string]map[string][]Measurement{
+		"device1": {"temp": []Measurement{{}}},
+	})
+
+	waitForDeliveries(t, target, 1)
+	time.Sleep(20 * time.Millisecond)
+	if n := target.count(); n != 1 {
+		t.Fatalf("got %d deliveries for a repeated subscribe to the same target, want 1 (overlapping broadcastSockets deliver duplicates)", n)
+	}
+}
+
+func TestBroadcasterRemoveTargetStopsDelivery(t *testing.T) {
+	b := NewBroadcaster()
+	target := &fakeBroadcastTarget{}
+
+	b.AddSocket("user1", "device1", []string{"temp"}, target)
+	b.RemoveTarget(target)
+
+	b.Send(map[string]map[string][]Measurement{
+		"device1": {"temp": []Measurement{{}}},
+	})
+
+	time.Sleep(20 * time.Millisecond)
+	if n := target.count(); n != 0 {
+		t.Fatalf("got %d deliveries after RemoveTarget, want 0", n)
+	}
+}
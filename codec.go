@@ -0,0 +1,138 @@
+package msg2api
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gorilla/websocket"
+)
+
+// cborSubprotocolSuffix marks a negotiated subprotocol as using CBORCodec
+// instead of the default JSONCodec, e.g. "v2.device.msg+cbor".
+const cborSubprotocolSuffix = "+cbor"
+
+// Codec encodes and decodes the values apiBase sends and receives, and
+// picks the websocket message type they travel in.
+type Codec interface {
+	Encode(v interface{}) (data []byte, messageType int, err error)
+	Decode(messageType int, data []byte, v interface{}) error
+}
+
+// JSONCodec encodes values as JSON text frames. It is the default and
+// preserves the API's original wire format.
+type JSONCodec struct{}
+
+// Encode implements Codec.
+func (JSONCodec) Encode(v interface{}) ([]byte, int, error) {
+	data, err := json.Marshal(v)
+	return data, websocket.TextMessage, err
+}
+
+// Decode implements Codec.
+func (JSONCodec) Decode(_ int, data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// CBORCodec encodes values as CBOR binary frames, cutting the wire size of
+// measurement-heavy traffic compared to JSONCodec.
+type CBORCodec struct{}
+
+// Encode implements Codec.
+func (CBORCodec) Encode(v interface{}) ([]byte, int, error) {
+	data, err := cbor.Marshal(v)
+	return data, websocket.BinaryMessage, err
+}
+
+// Decode implements Codec.
+func (CBORCodec) Decode(_ int, data []byte, v interface{}) error {
+	return cbor.Unmarshal(data, v)
+}
+
+// RawArgs holds a MessageIn's Args field exactly as it arrived on the wire,
+// remembering whether it was JSON or CBOR text, so Decode can unmarshal it
+// the way it was actually encoded instead of always assuming JSON. Without
+// this, a device's CBOR-encoded "update" payload would be handed to
+// encoding/json as opaque bytes and fail to decode, defeating the whole
+// point of negotiating CBORCodec for measurement-heavy traffic.
+type RawArgs struct {
+	cbor bool
+	data []byte
+}
+
+// Decode unmarshals r into v using whichever codec produced r's bytes.
+func (r RawArgs) Decode(v interface{}) error {
+	if len(r.data) == 0 {
+		return nil
+	}
+	if r.cbor {
+		return cbor.Unmarshal(r.data, v)
+	}
+	return json.Unmarshal(r.data, v)
+}
+
+// MarshalJSON implements json.Marshaler.
+func (r RawArgs) MarshalJSON() ([]byte, error) {
+	if len(r.data) == 0 {
+		return []byte("null"), nil
+	}
+	if !r.cbor {
+		return r.data, nil
+	}
+
+	var v interface{}
+	if err := cbor.Unmarshal(r.data, &v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// UnmarshalJSON implements json.Unmarshaler, capturing data verbatim.
+func (r *RawArgs) UnmarshalJSON(data []byte) error {
+	r.cbor = false
+	r.data = append([]byte(nil), data...)
+	return nil
+}
+
+// MarshalCBOR implements cbor.Marshaler.
+func (r RawArgs) MarshalCBOR() ([]byte, error) {
+	if len(r.data) == 0 {
+		return cbor.Marshal(nil)
+	}
+	if r.cbor {
+		return r.data, nil
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(r.data, &v); err != nil {
+		return nil, err
+	}
+	return cbor.Marshal(v)
+}
+
+// UnmarshalCBOR implements cbor.Unmarshaler, capturing data verbatim.
+func (r *RawArgs) UnmarshalCBOR(data []byte) error {
+	r.cbor = true
+	r.data = append([]byte(nil), data...)
+	return nil
+}
+
+// codecForSubprotocol returns the Codec negotiated by subprotocol, which is
+// CBORCodec for anything ending in cborSubprotocolSuffix and JSONCodec
+// otherwise.
+func codecForSubprotocol(subprotocol string) Codec {
+	if strings.HasSuffix(subprotocol, cborSubprotocolSuffix) {
+		return CBORCodec{}
+	}
+	return JSONCodec{}
+}
+
+// withCBORVariant returns protocols with a "+cbor" sibling appended after
+// each entry, so initAPIBaseFromHTTP can offer both and let the client pick.
+func withCBORVariant(protocols []string) []string {
+	result := make([]string, 0, len(protocols)*2)
+	for _, p := range protocols {
+		result = append(result, p, p+cborSubprotocolSuffix)
+	}
+	return result
+}
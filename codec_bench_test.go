@@ -0,0 +1,96 @@
+package msg2api
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+// benchmarkUpdateMessage builds a realistic "update" MessageIn, as sent by
+// a device with several sensors each reporting a batch of measurements, so
+// the benchmarks measure what actually goes out on the wire (envelope
+// included) rather than a bare payload that skips Args entirely.
+func benchmarkUpdateMessage(b *testing.B) MessageIn {
+	b.Helper()
+
+	var sample Measurement
+	if err := json.Unmarshal([]byte(`{"time":1690000000000,"value":23.5}`), &sample); err != nil {
+		b.Fatalf("building benchmark payload: %v", err)
+	}
+
+	values := make([]Measurement, 120)
+	for i := range values {
+		values[i] = sample
+	}
+
+	payload := make(map[string][]Measurement, 8)
+	for i := 0; i < 8; i++ {
+		payload[fmt.Sprintf("sensor-%d", i)] = values
+	}
+
+	args, err := json.Marshal(DeviceCmdUpdateArgs{Values: payload})
+	if err != nil {
+		b.Fatalf("building benchmark args: %v", err)
+	}
+
+	return MessageIn{Command: "update", Args: RawArgs{data: args}}
+}
+
+func BenchmarkJSONCodecEncodeUpdate(b *testing.B) {
+	msg := benchmarkUpdateMessage(b)
+	codec := JSONCodec{}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := codec.Encode(msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCBORCodecEncodeUpdate(b *testing.B) {
+	msg := benchmarkUpdateMessage(b)
+	codec := CBORCodec{}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := codec.Encode(msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchmarkRoundTrip decodes an already-encoded "update" message back into
+// a MessageIn and then decodes its Args into DeviceCmdUpdateArgs, exactly
+// as DeviceServer.doUpdate does, so the benchmark covers the path that
+// actually has to handle whichever codec was negotiated.
+func benchmarkRoundTrip(b *testing.B, codec Codec) {
+	b.Helper()
+
+	msg := benchmarkUpdateMessage(b)
+	data, messageType, err := codec.Encode(msg)
+	if err != nil {
+		b.Fatalf("encoding benchmark message: %v", err)
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var decoded MessageIn
+		if err := codec.Decode(messageType, data, &decoded); err != nil {
+			b.Fatal(err)
+		}
+
+		var args DeviceCmdUpdateArgs
+		if err := decoded.Args.Decode(&args); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkJSONCodecRoundTripUpdate(b *testing.B) {
+	benchmarkRoundTrip(b, JSONCodec{})
+}
+
+func BenchmarkCBORCodecRoundTripUpdate(b *testing.B) {
+	benchmarkRoundTrip(b, CBORCodec{})
+}
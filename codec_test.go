@@ -0,0 +1,47 @@
+package msg2api
+
+import "testing"
+
+type testArgsPayload struct {
+	Foo string `json:"foo"`
+	Bar int    `json:"bar"`
+}
+
+// TestRawArgsDecodesArgsForNegotiatedCodec guards against RawArgs silently
+// assuming JSON: a device that negotiated CBORCodec encodes its "update"
+// Args as a native CBOR map, not JSON text wrapped in a CBOR byte string,
+// so Args.Decode must use the codec the envelope actually arrived in.
+func TestRawArgsDecodesArgsForNegotiatedCodec(t *testing.T) {
+	codecs := []struct {
+		name  string
+		codec Codec
+	}{
+		{"json", JSONCodec{}},
+		{"cbor", CBORCodec{}},
+	}
+
+	for _, tc := range codecs {
+		t.Run(tc.name, func(t *testing.T) {
+			wire, messageType, err := tc.codec.Encode(MessageOut{
+				Command: "update",
+				Args:    testArgsPayload{Foo: "hi", Bar: 7},
+			})
+			if err != nil {
+				t.Fatalf("encoding: %v", err)
+			}
+
+			var in MessageIn
+			if err := tc.codec.Decode(messageType, wire, &in); err != nil {
+				t.Fatalf("decoding envelope: %v", err)
+			}
+
+			var args testArgsPayload
+			if err := in.Args.Decode(&args); err != nil {
+				t.Fatalf("decoding args: %v", err)
+			}
+			if args.Foo != "hi" || args.Bar != 7 {
+				t.Fatalf("decoded args = %+v, want {hi 7}", args)
+			}
+		})
+	}
+}
@@ -1,11 +1,6 @@
 package msg2api
 
 import (
-	"crypto/hmac"
-	"crypto/rand"
-	"crypto/sha256"
-	"encoding/hex"
-	"encoding/json"
 	"errors"
 	"github.com/gorilla/websocket"
 	"net/http"
@@ -17,6 +12,16 @@ import (
 type DeviceServer struct {
 	*apiBase
 
+	// DeviceID is the authenticated device's ID. It is set once Run's
+	// handshake succeeds. The default HMAC challenge cannot learn the
+	// device's identity, so with it DeviceID keeps the value set before Run.
+	DeviceID string
+
+	// Authenticator performs the handshake in Run. If nil, Run falls back
+	// to a HMACChallengeAuthenticator built from the key passed to it,
+	// preserving the original challenge-response behavior.
+	Authenticator Authenticator
+
 	// Update handles new measurement values coming from the device.
 	// 'values' maps a sensor ID to a measurement.
 	Update func(values map[string][]Measurement) *Error
@@ -34,89 +39,112 @@ type DeviceServer struct {
 
 var errAuthenticationFailed = errors.New("authentication failed")
 
-func (d *DeviceServer) authenticate(key []byte) error {
-	var buf [sha256.Size]byte
-
-	if _, err := rand.Read(buf[:]); err != nil {
-		return err
-	}
-
-	challenge := hex.EncodeToString(buf[:])
-	d.socket.Write(challenge)
-
-	msgRaw, err := d.socket.Receive()
-	switch {
-	case err != nil:
-		return err
-	}
-
-	msg, err := hex.DecodeString(string(msgRaw))
-	if err != nil {
-		return err
-	}
-
-	mac := hmac.New(sha256.New, key)
-	mac.Write(buf[:])
-	expected := mac.Sum(nil)
-	if !hmac.Equal(msg, expected) {
-		return errAuthenticationFailed
-	}
-	return d.socket.Write("proceed")
-}
-
 // Run tries to authenticate the DeviceServer to the Device over the websocket and
 // starts listening for commands from the Device on success.
 func (d *DeviceServer) Run(key []byte) error {
 	var err error
 
-	if err = d.authenticate(key); err != nil {
+	auth := d.Authenticator
+	if auth == nil {
+		auth = &HMACChallengeAuthenticator{DeviceID: d.DeviceID, Key: key}
+	}
+
+	if d.DeviceID, err = auth.Authenticate(d.socket); err != nil {
 		goto fail
 	}
 
 	for {
 		var msg MessageIn
 
-		if err = d.socket.ReceiveJSON(&msg); err != nil {
+		if err = d.ReadValue(&msg); err != nil {
 			goto fail
 		}
 
-		var opError *Error
-
-		switch msg.Command {
-		case "update":
-			opError = d.doUpdate(&msg)
-		case "addSensor":
-			opError = d.doAddSensor(&msg)
-		case "removeSensor":
-			opError = d.doRemoveSensor(&msg)
-		case "updateMetadata":
-			opError = d.doUpdateMetadata(&msg)
-		default:
-			opError = badCommand(msg.Command)
-		}
-
-		if opError != nil {
-			d.socket.WriteJSON(MessageOut{Error: opError})
-		} else {
-			now := time.Now().UnixNano() / 1e6
-			d.socket.WriteJSON(MessageOut{Now: &now})
-		}
+		d.Dispatch(func() {
+			d.handleMessage(&msg)
+		})
 	}
 
 fail:
-	d.socket.Close(websocket.CloseProtocolError, err.Error())
+	code := websocket.CloseProtocolError
+	if isTimeout(err) {
+		code = websocket.CloseAbnormalClosure
+	}
+	d.closeWith(code, err.Error())
 	return err
 }
 
 // RequestRealtimeUpdates forwards a request for realtime updates on the given sensor IDs to the device.
 func (d *DeviceServer) RequestRealtimeUpdates(sensors []string) {
-	d.socket.WriteJSON(MessageOut{Command: "requestRealtimeUpdates", Args: sensors})
+	d.WriteValue(MessageOut{Command: "requestRealtimeUpdates", Args: sensors})
+}
+
+// DeviceCmdBatchArgs are the arguments of the "batch" command: several
+// commands to run as a single round-trip.
+type DeviceCmdBatchArgs struct {
+	Messages []MessageIn `json:"messages"`
+}
+
+// handleMessage runs msg and writes back its MessageOut, echoing msg.ID so
+// the device can correlate the reply with the request that triggered it.
+func (d *DeviceServer) handleMessage(msg *MessageIn) {
+	if msg.Command == "batch" {
+		d.doBatch(msg)
+		return
+	}
+
+	if opError := d.evalCommand(msg); opError != nil {
+		d.WriteValue(MessageOut{ID: msg.ID, Error: opError})
+	} else {
+		now := time.Now().UnixNano() / 1e6
+		d.WriteValue(MessageOut{ID: msg.ID, Now: &now})
+	}
+}
+
+func (d *DeviceServer) evalCommand(msg *MessageIn) *Error {
+	switch msg.Command {
+	case "update":
+		return d.doUpdate(msg)
+	case "addSensor":
+		return d.doAddSensor(msg)
+	case "removeSensor":
+		return d.doRemoveSensor(msg)
+	case "updateMetadata":
+		return d.doUpdateMetadata(msg)
+	default:
+		return badCommand(msg.Command)
+	}
+}
+
+// doBatch runs every command in msg's DeviceCmdBatchArgs.Messages in order
+// and replies with their MessageOuts collected into a single "batch"
+// response, so a device can pipeline several commands in one round-trip.
+func (d *DeviceServer) doBatch(msg *MessageIn) {
+	var args DeviceCmdBatchArgs
+
+	if err := msg.Args.Decode(&args); err != nil {
+		d.WriteValue(MessageOut{ID: msg.ID, Error: invalidInput(err.Error(), "")})
+		return
+	}
+
+	results := make([]MessageOut, len(args.Messages))
+	for i := range args.Messages {
+		sub := &args.Messages[i]
+		if opError := d.evalCommand(sub); opError != nil {
+			results[i] = MessageOut{ID: sub.ID, Error: opError}
+		} else {
+			now := time.Now().UnixNano() / 1e6
+			results[i] = MessageOut{ID: sub.ID, Now: &now}
+		}
+	}
+
+	d.WriteValue(MessageOut{ID: msg.ID, Command: "batch", Args: results})
 }
 
 func (d *DeviceServer) doUpdate(msg *MessageIn) *Error {
 	var args DeviceCmdUpdateArgs
 
-	if err := json.Unmarshal(msg.Args, &args); err != nil {
+	if err := msg.Args.Decode(&args); err != nil {
 		return invalidInput(err.Error(), "")
 	}
 
@@ -130,7 +158,7 @@ func (d *DeviceServer) doUpdate(msg *MessageIn) *Error {
 func (d *DeviceServer) doAddSensor(msg *MessageIn) *Error {
 	var args DeviceCmdAddSensorArgs
 
-	if err := json.Unmarshal(msg.Args, &args); err != nil {
+	if err := msg.Args.Decode(&args); err != nil {
 		return invalidInput(err.Error(), "")
 	}
 
@@ -144,7 +172,7 @@ func (d *DeviceServer) doAddSensor(msg *MessageIn) *Error {
 func (d *DeviceServer) doRemoveSensor(msg *MessageIn) *Error {
 	var args DeviceCmdRemoveSensorArgs
 
-	if err := json.Unmarshal(msg.Args, &args); err != nil {
+	if err := msg.Args.Decode(&args); err != nil {
 		return invalidInput(err.Error(), "")
 	}
 
@@ -158,7 +186,7 @@ func (d *DeviceServer) doRemoveSensor(msg *MessageIn) *Error {
 func (d *DeviceServer) doUpdateMetadata(msg *MessageIn) *Error {
 	var args DeviceMetadata
 
-	if err := json.Unmarshal(msg.Args, &args); err != nil {
+	if err := msg.Args.Decode(&args); err != nil {
 		return invalidInput(err.Error(), "")
 	}
 
@@ -170,9 +198,12 @@ func (d *DeviceServer) doUpdateMetadata(msg *MessageIn) *Error {
 	return d.UpdateMetadata(&md)
 }
 
-// NewDeviceServer returns a new DeviceServer running on a websocket on the given http connection.
-func NewDeviceServer(w http.ResponseWriter, r *http.Request) (*DeviceServer, error) {
-	base, err := initAPIBaseFromHTTP(w, r, []string{deviceAPIProtocolV1})
+// NewDeviceServer returns a new DeviceServer running on a websocket on the
+// given http connection. Pass WithKeepalive to enable periodic pings and
+// idle-timeout detection, or WithReadLimit to override the default
+// per-message size limit.
+func NewDeviceServer(w http.ResponseWriter, r *http.Request, opts ...Option) (*DeviceServer, error) {
+	base, err := initAPIBaseFromHTTP(w, r, []string{deviceAPIProtocolV1}, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -182,3 +213,20 @@ func NewDeviceServer(w http.ResponseWriter, r *http.Request) (*DeviceServer, err
 	}
 	return result, nil
 }
+
+// NewDeviceServerWithAuth returns a new DeviceServer running on a websocket
+// on the given http connection, authenticating devices with auth instead
+// of the default HMAC challenge-response. Pass a HybridAuthenticator to
+// accept both a JWT and the legacy challenge on the same connection.
+func NewDeviceServerWithAuth(w http.ResponseWriter, r *http.Request, auth Authenticator, opts ...Option) (*DeviceServer, error) {
+	base, err := initAPIBaseFromHTTP(w, r, []string{deviceAPIProtocolV1}, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &DeviceServer{
+		apiBase:       base,
+		Authenticator: auth,
+	}
+	return result, nil
+}
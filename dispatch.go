@@ -0,0 +1,46 @@
+package msg2api
+
+const defaultWorkerPoolSize = 8
+
+// WithWorkerPool bounds how many commands a DeviceServer or UserServer
+// will process concurrently, so a client pipelining many requests (or a
+// single "batch" command) can't spawn unbounded goroutines. size must be
+// at least 1; it defaults to 8.
+func WithWorkerPool(size int) Option {
+	return func(c *apiBaseConfig) {
+		if size > 0 {
+			c.workerPoolSize = size
+		}
+	}
+}
+
+type writeRequest struct {
+	messageType int
+	data        []byte
+	result      chan<- error
+}
+
+// runWriter is the single goroutine that owns the socket for writing,
+// serializing the concurrent WriteValue calls that come from dispatched
+// commands and, for UserServer, from Broadcaster deliveries.
+func (b *apiBase) runWriter() {
+	for {
+		select {
+		case req := <-b.writes:
+			req.result <- b.socket.writeRaw(req.messageType, req.data)
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// Dispatch runs fn in its own goroutine, bounded by the server's worker
+// pool (see WithWorkerPool), so pipelined commands can run concurrently
+// instead of one at a time in the Run loop that reads them.
+func (b *apiBase) Dispatch(fn func()) {
+	b.dispatchSem <- struct{}{}
+	go func() {
+		defer func() { <-b.dispatchSem }()
+		fn()
+	}()
+}
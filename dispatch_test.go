@@ -0,0 +1,41 @@
+package msg2api
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDispatchBoundsConcurrency(t *testing.T) {
+	const poolSize = 2
+	const jobs = 6
+
+	b := &apiBase{dispatchSem: make(chan struct{}, poolSize)}
+
+	var current, max int32
+	var wg sync.WaitGroup
+	wg.Add(jobs)
+
+	for i := 0; i < jobs; i++ {
+		b.Dispatch(func() {
+			defer wg.Done()
+
+			n := atomic.AddInt32(&current, 1)
+			for {
+				m := atomic.LoadInt32(&max)
+				if n <= m || atomic.CompareAndSwapInt32(&max, m, n) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			atomic.AddInt32(&current, -1)
+		})
+	}
+
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&max); got > poolSize {
+		t.Fatalf("Dispatch ran %d jobs concurrently, want at most %d", got, poolSize)
+	}
+}
@@ -4,6 +4,7 @@
 // Each instance of the graphing page opens a websocket connection linked to the logged in user.
 // This connection is then used to request all currently known sensor metadata for display,
 // to retreive and receive recorded sensor values, and to request that devices send realtime updates for sensors which support it.
+// Realtime subscriptions for the same sensor are shared across UserServers by a Broadcaster, so the device only streams once no matter how many tabs are watching.
 //
 // The device API handles all device actions that involve sensors and sensor values.
 // With the device API, sensors can be created and removed, sensor metadata can be changed and sensor values can be sent.
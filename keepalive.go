@@ -0,0 +1,107 @@
+package msg2api
+
+import (
+	"github.com/gorilla/websocket"
+	"time"
+)
+
+// KeepaliveConfig enables periodic WebSocket pings and read/write
+// deadlines, so a dead connection behind NAT or a flaky mobile network is
+// detected and closed instead of silently going quiet.
+type KeepaliveConfig struct {
+	// PingInterval is how often a ping is sent to the peer.
+	PingInterval time.Duration
+
+	// PongTimeout is how long to wait for a pong before the connection is
+	// considered dead. Only a pong pushes the deadline out; other incoming
+	// messages do not.
+	PongTimeout time.Duration
+
+	// WriteTimeout bounds how long sending a single ping may take.
+	WriteTimeout time.Duration
+}
+
+// defaultKeepaliveWriteTimeout is used in place of KeepaliveConfig.WriteTimeout
+// when a caller enables keepalive without setting it, so a ping write can't
+// be given an already-elapsed deadline.
+const defaultKeepaliveWriteTimeout = 5 * time.Second
+
+func (c KeepaliveConfig) enabled() bool {
+	return c.PingInterval > 0 && c.PongTimeout > 0
+}
+
+// writeTimeout returns c.WriteTimeout, or defaultKeepaliveWriteTimeout if
+// the caller left it unset.
+func (c KeepaliveConfig) writeTimeout() time.Duration {
+	if c.WriteTimeout > 0 {
+		return c.WriteTimeout
+	}
+	return defaultKeepaliveWriteTimeout
+}
+
+// Option configures an apiBase at construction time. Pass one or more to
+// NewDeviceServer, NewDeviceServerWithAuth or NewUserServer.
+type Option func(*apiBaseConfig)
+
+type apiBaseConfig struct {
+	keepalive      KeepaliveConfig
+	workerPoolSize int
+	readLimit      int64
+}
+
+// WithKeepalive enables periodic pings and read/write deadlines as
+// described by cfg.
+func WithKeepalive(cfg KeepaliveConfig) Option {
+	return func(c *apiBaseConfig) {
+		c.keepalive = cfg
+	}
+}
+
+// WithReadLimit overrides the maximum size, in bytes, of a single incoming
+// websocket message. It defaults to defaultReadLimit.
+func WithReadLimit(limit int64) Option {
+	return func(c *apiBaseConfig) {
+		c.readLimit = limit
+	}
+}
+
+func newAPIBaseConfig(opts []Option) apiBaseConfig {
+	cfg := apiBaseConfig{workerPoolSize: defaultWorkerPoolSize, readLimit: defaultReadLimit}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return cfg
+}
+
+// startKeepalive does nothing unless cfg is enabled. Otherwise it applies
+// cfg's read deadline and pong handler to b's socket and spawns a goroutine
+// that pings the peer on every PingInterval until b is closed. A missed pong
+// (or any other read timeout) surfaces as a read error from ReadValue in the
+// caller's Run loop, which closes the connection with CloseAbnormalClosure.
+func (b *apiBase) startKeepalive(cfg KeepaliveConfig) {
+	if !cfg.enabled() {
+		return
+	}
+
+	b.socket.setReadDeadline(time.Now().Add(cfg.PongTimeout))
+	b.socket.setPongHandler(func() error {
+		return b.socket.setReadDeadline(time.Now().Add(cfg.PongTimeout))
+	})
+
+	go func() {
+		ticker := time.NewTicker(cfg.PingInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := b.socket.writePing(cfg.writeTimeout()); err != nil {
+					b.closeWith(websocket.CloseAbnormalClosure, err.Error())
+					return
+				}
+			case <-b.done:
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,27 @@
+package msg2api
+
+// MessageIn is a single incoming command, received from either a Device or
+// a User over their respective websocket APIs.
+type MessageIn struct {
+	// ID, when set by the caller, is echoed back on the MessageOut that
+	// answers this command, so a client issuing several commands before
+	// waiting for a reply can correlate each response with the request that
+	// triggered it. Pushes such as "update" carry no ID.
+	ID *string `json:"id,omitempty"`
+
+	Command string  `json:"command"`
+	Args    RawArgs `json:"args"`
+}
+
+// MessageOut is a single outgoing response or push, sent to either a
+// Device or a User over their respective websocket APIs.
+type MessageOut struct {
+	// ID echoes the MessageIn.ID of the command this message answers. It
+	// is nil for unprompted pushes such as "update".
+	ID *string `json:"id,omitempty"`
+
+	Command string      `json:"command,omitempty"`
+	Args    interface{} `json:"args,omitempty"`
+	Error   *Error      `json:"error,omitempty"`
+	Now     *int64      `json:"now,omitempty"`
+}
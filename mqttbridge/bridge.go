@@ -0,0 +1,217 @@
+// Package mqttbridge lets MQTT-only devices feed the same handler surface
+// as msg2api.DeviceServer. Messages published on msg2api/<deviceID>/<topic>
+// are decoded with the same wire schemas DeviceServer uses and dispatched
+// to the same kind of Update, AddSensor, RemoveSensor and UpdateMetadata
+// callbacks, so backend code written against DeviceServer doesn't need to
+// change to also serve devices that only speak MQTT.
+package mqttbridge
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"sync"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"github.com/mysmartgrid/msg2api"
+)
+
+const topicPrefix = "msg2api"
+
+// KeyStore resolves a device's pre-shared key, exactly like the key
+// DeviceServer.Run is given out of band.
+type KeyStore interface {
+	DeviceKey(deviceID string) ([]byte, error)
+}
+
+// Bridge runs an MQTT client that serves the same handler surface as
+// DeviceServer for devices connected to an MQTT broker instead of a
+// websocket.
+type Bridge struct {
+	// Update handles new measurement values published by a device.
+	Update func(deviceID string, values map[string][]msg2api.Measurement) *msg2api.Error
+
+	// AddSensor is called when a device wants to register a new sensor.
+	AddSensor func(deviceID, name, unit string, port int32, factor float64) *msg2api.Error
+
+	// RemoveSensor is called when a device wants to deregister a sensor.
+	RemoveSensor func(deviceID, name string) *msg2api.Error
+
+	// UpdateMetadata handles metadata updates for sensors and the device itself.
+	UpdateMetadata func(deviceID string, metadata *msg2api.DeviceMetadata) *msg2api.Error
+
+	// Keys resolves a device's pre-shared key for VerifyCredentials.
+	Keys KeyStore
+
+	// QoS is used for every subscription and publish the bridge makes.
+	// Defaults to 1.
+	QoS byte
+
+	// Retain marks challenge-topic publishes as retained, so a device
+	// reconnecting before it has polled gets the nonce immediately.
+	Retain bool
+
+	mu     sync.Mutex
+	nonces map[string][]byte
+
+	client mqtt.Client
+}
+
+// SetHandlers assigns the DeviceServer-like callbacks the bridge
+// dispatches incoming device messages to.
+func (b *Bridge) SetHandlers(
+	update func(deviceID string, values map[string][]msg2api.Measurement) *msg2api.Error,
+	addSensor func(deviceID, name, unit string, port int32, factor float64) *msg2api.Error,
+	removeSensor func(deviceID, name string) *msg2api.Error,
+	updateMetadata func(deviceID string, metadata *msg2api.DeviceMetadata) *msg2api.Error,
+) {
+	b.Update = update
+	b.AddSensor = addSensor
+	b.RemoveSensor = removeSensor
+	b.UpdateMetadata = updateMetadata
+}
+
+// NewBridge returns a Bridge that will connect to the broker described by
+// opts once Run is called. keys resolves device keys for the challenge
+// authentication scheme.
+func NewBridge(opts *mqtt.ClientOptions, keys KeyStore) *Bridge {
+	b := &Bridge{Keys: keys, QoS: 1, nonces: make(map[string][]byte)}
+	b.client = mqtt.NewClient(opts)
+	return b
+}
+
+// Run connects to the broker, subscribes to every device's topics and
+// serves incoming messages until ctx is canceled.
+func (b *Bridge) Run(ctx context.Context) error {
+	if token := b.client.Connect(); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+	defer b.client.Disconnect(250)
+
+	token := b.client.Subscribe(topicPrefix+"/+/+", b.QoS, b.handleMessage)
+	if token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// ChallengeDevice publishes a fresh random nonce to deviceID's challenge
+// topic, records it as the nonce VerifyCredentials should expect next for
+// deviceID, and returns it. The broker's auth plugin is expected to call
+// VerifyCredentials once the device reconnects with MQTT username deviceID
+// and password hex(HMAC-SHA256(nonce, key)).
+func (b *Bridge) ChallengeDevice(deviceID string) ([]byte, error) {
+	var nonce [sha256.Size]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+
+	topic := topicPrefix + "/" + deviceID + "/challenge"
+	token := b.client.Publish(topic, b.QoS, b.Retain, hex.EncodeToString(nonce[:]))
+	if token.Wait() && token.Error() != nil {
+		return nil, token.Error()
+	}
+
+	b.mu.Lock()
+	b.nonces[deviceID] = nonce[:]
+	b.mu.Unlock()
+
+	return nonce[:], nil
+}
+
+// VerifyCredentials checks an MQTT CONNECT's username/password against the
+// nonce this Bridge last issued to deviceID via ChallengeDevice. The nonce
+// is consumed the first time it's checked, whether or not password matches,
+// so a captured username/password pair can't be replayed against a later
+// connection attempt; the device must be challenged again first. It is
+// meant to be called from the broker's authentication plugin running in
+// the same process as this Bridge.
+func (b *Bridge) VerifyCredentials(deviceID, password string) (bool, error) {
+	b.mu.Lock()
+	nonce, ok := b.nonces[deviceID]
+	delete(b.nonces, deviceID)
+	b.mu.Unlock()
+
+	if !ok {
+		return false, nil
+	}
+
+	key, err := b.Keys.DeviceKey(deviceID)
+	if err != nil {
+		return false, err
+	}
+
+	msg, err := hex.DecodeString(password)
+	if err != nil {
+		return false, nil
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(nonce)
+	return hmac.Equal(msg, mac.Sum(nil)), nil
+}
+
+func (b *Bridge) handleMessage(_ mqtt.Client, msg mqtt.Message) {
+	deviceID, leaf, ok := splitTopic(msg.Topic())
+	if !ok {
+		return
+	}
+
+	switch leaf {
+	case "update":
+		b.doUpdate(deviceID, msg.Payload())
+	case "addSensor":
+		b.doAddSensor(deviceID, msg.Payload())
+	case "removeSensor":
+		b.doRemoveSensor(deviceID, msg.Payload())
+	case "updateMetadata":
+		b.doUpdateMetadata(deviceID, msg.Payload())
+	}
+}
+
+func splitTopic(topic string) (deviceID, leaf string, ok bool) {
+	parts := strings.Split(topic, "/")
+	if len(parts) != 3 || parts[0] != topicPrefix {
+		return "", "", false
+	}
+	return parts[1], parts[2], true
+}
+
+func (b *Bridge) doUpdate(deviceID string, payload []byte) {
+	var args msg2api.DeviceCmdUpdateArgs
+	if json.Unmarshal(payload, &args) != nil || b.Update == nil {
+		return
+	}
+	b.Update(deviceID, args.Values)
+}
+
+func (b *Bridge) doAddSensor(deviceID string, payload []byte) {
+	var args msg2api.DeviceCmdAddSensorArgs
+	if json.Unmarshal(payload, &args) != nil || b.AddSensor == nil {
+		return
+	}
+	b.AddSensor(deviceID, args.Name, args.Unit, args.Port, args.Factor)
+}
+
+func (b *Bridge) doRemoveSensor(deviceID string, payload []byte) {
+	var args msg2api.DeviceCmdRemoveSensorArgs
+	if json.Unmarshal(payload, &args) != nil || b.RemoveSensor == nil {
+		return
+	}
+	b.RemoveSensor(deviceID, args.Name)
+}
+
+func (b *Bridge) doUpdateMetadata(deviceID string, payload []byte) {
+	var args msg2api.DeviceMetadata
+	if json.Unmarshal(payload, &args) != nil || b.UpdateMetadata == nil {
+		return
+	}
+	b.UpdateMetadata(deviceID, &args)
+}
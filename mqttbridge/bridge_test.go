@@ -0,0 +1,211 @@
+package mqttbridge
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"github.com/mysmartgrid/msg2api"
+)
+
+type fakeToken struct {
+	err error
+}
+
+func (f *fakeToken) Wait() bool                     { return true }
+func (f *fakeToken) WaitTimeout(time.Duration) bool { return true }
+func (f *fakeToken) Done() <-chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}
+func (f *fakeToken) Error() error { return f.err }
+
+type publishedMessage struct {
+	topic   string
+	payload interface{}
+}
+
+type fakeClient struct {
+	published []publishedMessage
+}
+
+func (c *fakeClient) IsConnected() bool      { return true }
+func (c *fakeClient) IsConnectionOpen() bool { return true }
+func (c *fakeClient) Connect() mqtt.Token    { return &fakeToken{} }
+func (c *fakeClient) Disconnect(uint)        {}
+func (c *fakeClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	c.published = append(c.published, publishedMessage{topic: topic, payload: payload})
+	return &fakeToken{}
+}
+func (c *fakeClient) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	return &fakeToken{}
+}
+func (c *fakeClient) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	return &fakeToken{}
+}
+func (c *fakeClient) Unsubscribe(topics ...string) mqtt.Token             { return &fakeToken{} }
+func (c *fakeClient) AddRoute(topic string, callback mqtt.MessageHandler) {}
+func (c *fakeClient) OptionsReader() mqtt.ClientOptionsReader             { return mqtt.ClientOptionsReader{} }
+
+type fakeMessage struct {
+	topic   string
+	payload []byte
+}
+
+func (m fakeMessage) Duplicate() bool   { return false }
+func (m fakeMessage) Qos() byte         { return 0 }
+func (m fakeMessage) Retained() bool    { return false }
+func (m fakeMessage) Topic() string     { return m.topic }
+func (m fakeMessage) MessageID() uint16 { return 0 }
+func (m fakeMessage) Payload() []byte   { return m.payload }
+func (m fakeMessage) Ack()              {}
+
+type fakeKeyStore struct {
+	key []byte
+}
+
+func (k fakeKeyStore) DeviceKey(deviceID string) ([]byte, error) {
+	return k.key, nil
+}
+
+func newTestBridge(key []byte) (*Bridge, *fakeClient) {
+	client := &fakeClient{}
+	b := &Bridge{Keys: fakeKeyStore{key: key}, QoS: 1, nonces: make(map[string][]byte)}
+	b.client = client
+	return b, client
+}
+
+func TestChallengeDeviceThenVerifyCredentials(t *testing.T) {
+	b, client := newTestBridge([]byte("secret"))
+
+	nonce, err := b.ChallengeDevice("device1")
+	if err != nil {
+		t.Fatalf("ChallengeDevice: %v", err)
+	}
+	if len(client.published) != 1 || client.published[0].topic != "msg2api/device1/challenge" {
+		t.Fatalf("unexpected publish: %+v", client.published)
+	}
+
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(nonce)
+	password := hex.EncodeToString(mac.Sum(nil))
+
+	ok, err := b.VerifyCredentials("device1", password)
+	if err != nil {
+		t.Fatalf("VerifyCredentials: %v", err)
+	}
+	if !ok {
+		t.Fatalf("VerifyCredentials rejected a correctly derived password")
+	}
+
+	ok, err = b.VerifyCredentials("device1", password)
+	if err != nil {
+		t.Fatalf("VerifyCredentials (replay): %v", err)
+	}
+	if ok {
+		t.Fatalf("VerifyCredentials accepted a replayed nonce/password pair")
+	}
+}
+
+func TestVerifyCredentialsRejectsWrongPassword(t *testing.T) {
+	b, _ := newTestBridge([]byte("secret"))
+
+	if _, err := b.ChallengeDevice("device1"); err != nil {
+		t.Fatalf("ChallengeDevice: %v", err)
+	}
+
+	ok, err := b.VerifyCredentials("device1", hex.EncodeToString([]byte("wrong")))
+	if err != nil {
+		t.Fatalf("VerifyCredentials: %v", err)
+	}
+	if ok {
+		t.Fatalf("VerifyCredentials accepted a wrong password")
+	}
+}
+
+func TestVerifyCredentialsRejectsWithoutChallenge(t *testing.T) {
+	b, _ := newTestBridge([]byte("secret"))
+
+	ok, err := b.VerifyCredentials("device1", hex.EncodeToString([]byte("whatever")))
+	if err != nil {
+		t.Fatalf("VerifyCredentials: %v", err)
+	}
+	if ok {
+		t.Fatalf("VerifyCredentials accepted a device that was never challenged")
+	}
+}
+
+func TestSplitTopic(t *testing.T) {
+	cases := []struct {
+		topic    string
+		deviceID string
+		leaf     string
+		ok       bool
+	}{
+		{"msg2api/device1/update", "device1", "update", true},
+		{"msg2api/device1", "", "", false},
+		{"other/device1/update", "", "", false},
+	}
+
+	for _, c := range cases {
+		deviceID, leaf, ok := splitTopic(c.topic)
+		if ok != c.ok || deviceID != c.deviceID || leaf != c.leaf {
+			t.Errorf("splitTopic(%q) = (%q, %q, %v), want (%q, %q, %v)", c.topic, deviceID, leaf, ok, c.deviceID, c.leaf, c.ok)
+		}
+	}
+}
+
+func TestHandleMessageDispatchesUpdate(t *testing.T) {
+	b, client := newTestBridge([]byte("secret"))
+
+	var sample msg2api.Measurement
+	if err := json.Unmarshal([]byte(`{"time":1690000000000,"value":23.5}`), &sample); err != nil {
+		t.Fatalf("building sample measurement: %v", err)
+	}
+
+	payload, err := json.Marshal(msg2api.DeviceCmdUpdateArgs{
+		Values: map[string][]msg2api.Measurement{"temp": {sample}},
+	})
+	if err != nil {
+		t.Fatalf("marshaling update args: %v", err)
+	}
+
+	var gotDeviceID string
+	var gotValues map[string][]msg2api.Measurement
+	b.Update = func(deviceID string, values map[string][]msg2api.Measurement) *msg2api.Error {
+		gotDeviceID = deviceID
+		gotValues = values
+		return nil
+	}
+
+	b.handleMessage(client, fakeMessage{topic: "msg2api/device1/update", payload: payload})
+
+	if gotDeviceID != "device1" {
+		t.Fatalf("Update called with deviceID %q, want %q", gotDeviceID, "device1")
+	}
+	if len(gotValues["temp"]) != 1 {
+		t.Fatalf("Update called with values %+v, want one temp measurement", gotValues)
+	}
+}
+
+func TestHandleMessageIgnoresUnknownTopic(t *testing.T) {
+	b, client := newTestBridge([]byte("secret"))
+
+	called := false
+	b.Update = func(deviceID string, values map[string][]msg2api.Measurement) *msg2api.Error {
+		called = true
+		return nil
+	}
+
+	b.handleMessage(client, fakeMessage{topic: "other/device1/update", payload: []byte("{}")})
+
+	if called {
+		t.Fatalf("handleMessage dispatched a message on a topic outside topicPrefix")
+	}
+}
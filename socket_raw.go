@@ -0,0 +1,39 @@
+package msg2api
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// writeRaw sends a pre-encoded message of the given websocket message type.
+// apiBase's writer goroutine sends every Codec's output through it,
+// JSONCodec included.
+func (s *socketWrapper) writeRaw(messageType int, data []byte) error {
+	return s.conn.WriteMessage(messageType, data)
+}
+
+// readRaw reads the next websocket frame and returns its message type
+// along with the raw payload, for decoding by a Codec.
+func (s *socketWrapper) readRaw() (messageType int, data []byte, err error) {
+	return s.conn.ReadMessage()
+}
+
+// setReadDeadline bounds how long the next read may block before it fails
+// with a timeout error, used by KeepaliveConfig to detect dead connections.
+func (s *socketWrapper) setReadDeadline(t time.Time) error {
+	return s.conn.SetReadDeadline(t)
+}
+
+// setPongHandler installs fn to run whenever a pong is received, so
+// KeepaliveConfig can push the read deadline back out.
+func (s *socketWrapper) setPongHandler(fn func() error) {
+	s.conn.SetPongHandler(func(string) error {
+		return fn()
+	})
+}
+
+// writePing sends a ping control frame, bounded by timeout.
+func (s *socketWrapper) writePing(timeout time.Duration) error {
+	return s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(timeout))
+}
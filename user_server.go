@@ -1,58 +1,172 @@
 package msg2api
 
 import (
-	"encoding/json"
+	"errors"
 	"github.com/gorilla/websocket"
 	"net/http"
 	"time"
 )
 
+var errBroadcasterNotConfigured = errors.New("subscriptions are not supported on this server")
+
 type UserServer struct {
 	*apiBase
 
+	// UserID identifies this UserServer's logged-in user for Broadcaster
+	// bookkeeping. It must be set before Subscribe is called.
+	UserID string
+
 	GetValues func(since time.Time, withMetadata bool) error
+
+	// Broadcaster, when set, lets several UserServers share a single
+	// realtime subscription to the same sensor instead of each holding its
+	// own DeviceServer link. It must be set before Subscribe is called.
+	Broadcaster *Broadcaster
+
+	// RequestRealtimeUpdates is invoked with the sensors on deviceID that
+	// the Broadcaster isn't already streaming, so the caller can forward
+	// the request to the right DeviceServer. It is only called once per
+	// sensor no matter how many UserServers subscribe to it.
+	RequestRealtimeUpdates func(deviceID string, sensorIDs []string) error
+}
+
+// UserCmdSubscribeArgs are the arguments of the "subscribe" command.
+type UserCmdSubscribeArgs struct {
+	DeviceID  string   `json:"device"`
+	SensorIDs []string `json:"sensors"`
 }
 
 func (u *UserServer) Run() error {
 	for {
 		var msg MessageIn
 
-		if err := u.socket.ReceiveJSON(&msg); err != nil {
-			u.socket.Close(websocket.CloseProtocolError, err.Error())
+		if err := u.ReadValue(&msg); err != nil {
+			code := websocket.CloseProtocolError
+			if isTimeout(err) {
+				code = websocket.CloseAbnormalClosure
+			}
+			u.closeWith(code, err.Error())
+			if u.Broadcaster != nil {
+				u.Broadcaster.RemoveTarget(u)
+			}
 			return err
 		}
 
-		var opError *Error
+		u.Dispatch(func() {
+			u.handleMessage(&msg)
+		})
+	}
 
-		switch msg.Command {
-		case "getValues":
-			opError = u.doGetValues(&msg)
+	return nil
+}
 
-		default:
-			u.socket.WriteJSON(MessageOut{Error: badCommand(msg.Command)})
-		}
+func (u *UserServer) SendUpdate(values map[string]map[string][]Measurement) error {
+	return u.deliverUpdate(MessageOut{Command: "update", Args: values})
+}
+
+func (u *UserServer) SendMetadata(data UserEventMetadataArgs) error {
+	return u.WriteValue(MessageOut{Command: "metadata", Args: data})
+}
+
+// deliverUpdate writes msg to the underlying socket. It implements
+// BroadcastTarget; WriteValue itself serializes concurrent callers, so a
+// Broadcaster delivery can never interleave with a dispatched command's
+// response.
+func (u *UserServer) deliverUpdate(msg MessageOut) error {
+	return u.WriteValue(msg)
+}
 
-		if opError != nil {
-			u.socket.WriteJSON(MessageOut{Error: opError})
+// UserCmdBatchArgs are the arguments of the "batch" command: several
+// commands to run as a single round-trip.
+type UserCmdBatchArgs struct {
+	Messages []MessageIn `json:"messages"`
+}
+
+// handleMessage runs msg and, if it fails, writes back a MessageOut carrying
+// the error and echoing msg.ID so the client can correlate the reply with
+// the request that triggered it. A successful command gets no reply, except
+// "batch", which always answers with its collected results.
+func (u *UserServer) handleMessage(msg *MessageIn) {
+	if msg.Command == "batch" {
+		u.doBatch(msg)
+		return
+	}
+
+	if opError := u.evalCommand(msg); opError != nil {
+		u.WriteValue(MessageOut{ID: msg.ID, Error: opError})
+	}
+}
+
+func (u *UserServer) evalCommand(msg *MessageIn) *Error {
+	switch msg.Command {
+	case "getValues":
+		return u.doGetValues(msg)
+	case "subscribe":
+		return u.doSubscribe(msg)
+	default:
+		return badCommand(msg.Command)
+	}
+}
+
+// doBatch runs every command in msg's UserCmdBatchArgs.Messages in order
+// and replies with their results collected into a single "batch" response,
+// so a client can pipeline several commands in one round-trip.
+func (u *UserServer) doBatch(msg *MessageIn) {
+	var args UserCmdBatchArgs
+
+	if err := msg.Args.Decode(&args); err != nil {
+		u.WriteValue(MessageOut{ID: msg.ID, Error: invalidInput(err.Error(), "")})
+		return
+	}
+
+	results := make([]MessageOut, len(args.Messages))
+	for i := range args.Messages {
+		sub := &args.Messages[i]
+		if opError := u.evalCommand(sub); opError != nil {
+			results[i] = MessageOut{ID: sub.ID, Error: opError}
+		} else {
+			results[i] = MessageOut{ID: sub.ID}
 		}
 	}
 
-	return nil
+	u.WriteValue(MessageOut{ID: msg.ID, Command: "batch", Args: results})
 }
 
-func (u *UserServer) SendUpdate(values map[string]map[string][]Measurement) error {
-	return u.socket.WriteJSON(MessageOut{Command: "update", Args: values})
+// Subscribe asks for realtime updates on sensorIDs of deviceID to be
+// delivered to this UserServer, multiplexing the underlying
+// DeviceServer.RequestRealtimeUpdates call across every other UserServer
+// that is interested in the same sensors via Broadcaster.
+func (u *UserServer) Subscribe(deviceID string, sensorIDs []string) error {
+	if u.Broadcaster == nil {
+		return errBroadcasterNotConfigured
+	}
+
+	newSensors := u.Broadcaster.AddSocket(u.UserID, deviceID, sensorIDs, u)
+	if len(newSensors) == 0 || u.RequestRealtimeUpdates == nil {
+		return nil
+	}
+
+	return u.RequestRealtimeUpdates(deviceID, newSensors)
 }
 
-func (u *UserServer) SendMetadata(data UserEventMetadataArgs) error {
-	return u.socket.WriteJSON(MessageOut{Command: "metadata", Args: data})
+func (u *UserServer) doSubscribe(cmd *MessageIn) *Error {
+	var args UserCmdSubscribeArgs
+
+	if err := cmd.Args.Decode(&args); err != nil {
+		return invalidInput(err.Error(), "")
+	}
+
+	if err := u.Subscribe(args.DeviceID, args.SensorIDs); err != nil {
+		return operationFailed(err.Error())
+	}
+	return nil
 }
 
 func (u *UserServer) doGetValues(cmd *MessageIn) *Error {
 	var args UserCmdGetValuesArgs
 	var err error
 
-	if err = json.Unmarshal(cmd.Args, &args); err != nil {
+	if err = cmd.Args.Decode(&args); err != nil {
 		return operationFailed(err.Error())
 	}
 
@@ -67,8 +181,12 @@ func (u *UserServer) doGetValues(cmd *MessageIn) *Error {
 	return nil
 }
 
-func NewUserServer(w http.ResponseWriter, r *http.Request) (*UserServer, error) {
-	base, err := initApiBaseFromHttp(w, r, []string{userApiProtocolV1})
+// NewUserServer returns a new UserServer running on a websocket on the
+// given http connection. Pass WithKeepalive to enable periodic pings and
+// idle-timeout detection, or WithReadLimit to override the default
+// per-message size limit.
+func NewUserServer(w http.ResponseWriter, r *http.Request, opts ...Option) (*UserServer, error) {
+	base, err := initAPIBaseFromHTTP(w, r, []string{userAPIProtocolV3}, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,70 @@
+package msg2api
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func newTestUserServer() (*UserServer, chan writeRequest) {
+	writes := make(chan writeRequest)
+	base := &apiBase{
+		codec:       JSONCodec{},
+		done:        make(chan struct{}),
+		writes:      writes,
+		dispatchSem: make(chan struct{}, 1),
+	}
+
+	u := &UserServer{apiBase: base}
+	u.GetValues = func(since time.Time, withMetadata bool) error { return nil }
+	return u, writes
+}
+
+func TestUserServerBatchEchoesCorrelationIDs(t *testing.T) {
+	u, writes := newTestUserServer()
+
+	captured := make(chan MessageOut, 1)
+	go func() {
+		for req := range writes {
+			var out MessageOut
+			json.Unmarshal(req.data, &out)
+			captured <- out
+			req.result <- nil
+		}
+	}()
+
+	outerID, innerID1, innerID2 := "outer", "inner1", "inner2"
+	sub, _ := json.Marshal(UserCmdGetValuesArgs{})
+	batchArgs, _ := json.Marshal(UserCmdBatchArgs{
+		Messages: []MessageIn{
+			{ID: &innerID1, Command: "getValues", Args: RawArgs{data: sub}},
+			{ID: &innerID2, Command: "getValues", Args: RawArgs{data: sub}},
+		},
+	})
+
+	u.handleMessage(&MessageIn{ID: &outerID, Command: "batch", Args: RawArgs{data: batchArgs}})
+
+	out := <-captured
+	if out.ID == nil || *out.ID != outerID {
+		t.Fatalf("batch response ID = %v, want %q", out.ID, outerID)
+	}
+
+	raw, err := json.Marshal(out.Args)
+	if err != nil {
+		t.Fatalf("re-marshal batch args: %v", err)
+	}
+
+	var results []MessageOut
+	if err := json.Unmarshal(raw, &results); err != nil {
+		t.Fatalf("unmarshal batch results: %v", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("got %d batch results, want 2", len(results))
+	}
+	if results[0].ID == nil || *results[0].ID != innerID1 {
+		t.Fatalf("results[0].ID = %v, want %q", results[0].ID, innerID1)
+	}
+	if results[1].ID == nil || *results[1].ID != innerID2 {
+		t.Fatalf("results[1].ID = %v, want %q", results[1].ID, innerID2)
+	}
+}